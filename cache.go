@@ -0,0 +1,98 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultResponseCacheSize is the number of entries kept when ServerOptions
+// does not specify an explicit ResponseCacheSize.
+const defaultResponseCacheSize = 10000
+
+// cacheEntry records the outcome of a previously processed image variant so
+// that an identical request can be answered without re-running the bimg
+// pipeline or re-uploading to Minio.
+type cacheEntry struct {
+	key          string
+	etag         string
+	lastModified time.Time
+	publicURL    string
+}
+
+// ResponseCache is a bounded, in-memory LRU index of processed image
+// variants, keyed by the normalized request that produced them.
+type ResponseCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+// NewResponseCache creates a ResponseCache holding at most capacity entries.
+// A capacity <= 0 falls back to defaultResponseCacheSize.
+func NewResponseCache(capacity int) *ResponseCache {
+	if capacity <= 0 {
+		capacity = defaultResponseCacheSize
+	}
+	return &ResponseCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached entry for key, if any, and marks it most recently used.
+func (c *ResponseCache) Get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		responseCacheMisses.Inc()
+		return cacheEntry{}, false
+	}
+	c.ll.MoveToFront(el)
+	responseCacheHits.Inc()
+	return el.Value.(cacheEntry), true
+}
+
+// Set stores or refreshes entry, evicting the least recently used entry if
+// the cache is over capacity.
+func (c *ResponseCache) Set(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[entry.key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[entry.key] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(cacheEntry).key)
+	}
+}
+
+// conditionalRequestSatisfied reports whether r carries an If-None-Match or
+// If-Modified-Since header that is satisfied by the given ETag/modification
+// time, meaning the caller already holds a fresh copy of the resource.
+func conditionalRequestSatisfied(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return inm == etag || inm == "*"
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		// The header only carries whole seconds, so compare at that precision.
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
+	"net/url"
 	"path/filepath"
-	"crypto/md5"
 	"strings"
+	"time"
 
 	"gopkg.in/h2non/bimg.v1"
 	"gopkg.in/h2non/filetype.v0"
-	"github.com/minio/minio-go"
 )
 
 func indexController(w http.ResponseWriter, r *http.Request) {
@@ -36,6 +41,35 @@ func healthController(w http.ResponseWriter, r *http.Request) {
 
 func imageController(o ServerOptions, operation Operation) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if claims := claimsFromContext(req.Context()); claims != nil {
+			if !claims.AllowsOperation(operationName(req)) {
+				ErrorReply(req, w, ErrInvalidJWT, o)
+				return
+			}
+			if sourceURL := req.URL.Query().Get("url"); sourceURL != "" {
+				if u, err := url.Parse(sourceURL); err == nil && !claims.AllowsHost(u.Hostname()) {
+					ErrorReply(req, w, ErrInvalidJWT, o)
+					return
+				}
+			}
+		}
+
+		if sourceURL := req.URL.Query().Get("url"); sourceURL != "" && o.Storage != nil {
+			if key, ok := storageSourceKey(sourceURL); ok {
+				buf, err := fetchFromStorage(req.Context(), o.Storage, key)
+				if err != nil {
+					ErrorReply(req, w, NewError(err.Error(), BadRequest), o)
+					return
+				}
+				if len(buf) == 0 {
+					ErrorReply(req, w, ErrEmptyBody, o)
+					return
+				}
+				imageHandler(w, req, buf, operation, o)
+				return
+			}
+		}
+
 		var imageSource = MatchSource(req)
 		if imageSource == nil {
 			ErrorReply(req, w, ErrMissingImageSource, o)
@@ -57,6 +91,42 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 	}
 }
 
+// storageSourceKey reports whether sourceURL names an object in the
+// configured Storage backend via a "storage://<key>" URL, returning its key.
+// This is what lets url= sources reach private buckets the source HTTP
+// client (MatchSource's url.go fetcher) has no credentials for.
+func storageSourceKey(sourceURL string) (string, bool) {
+	const scheme = "storage://"
+	if !strings.HasPrefix(sourceURL, scheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(sourceURL, scheme), true
+}
+
+// fetchFromStorage reads an object straight out of the configured Storage
+// backend, checking existence with Head before paying for a Get.
+func fetchFromStorage(ctx context.Context, storage Storage, key string) ([]byte, error) {
+	ok, err := storage.Head(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("storage: head %s: %w", key, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("storage: object %q not found", key)
+	}
+
+	rc, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("storage: get %s: %w", key, err)
+	}
+	defer rc.Close()
+
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("storage: read %s: %w", key, err)
+	}
+	return buf, nil
+}
+
 func determineAcceptMimeType(accept string) string {
 	for _, v := range strings.Split(accept, ",") {
 		mediaType, _, _ := mime.ParseMediaType(v)
@@ -73,25 +143,58 @@ func determineAcceptMimeType(accept string) string {
 }
 
 
-func UploadMinio(img *Image, fileName string, opts *MinioOptions) (publicUrl string, err error){
-	// Initialize minio client object.
-	minioClient, err := minio.New(opts.Endpoint, opts.AccessKey, opts.SecretKey, opts.UseSSL)
-	if err != nil {
-		exitWithError("Failed to initialize Minio: %s", err)
-		return
-	}
+// uploadToStorage streams img.Body to the configured Storage backend while
+// computing its SHA-256 content hash via io.TeeReader, so callers get a
+// stable ETag without buffering the body twice. operation labels the
+// storage-upload-duration metric and names the trace span.
+func uploadToStorage(ctx context.Context, storage Storage, img *Image, fileName string, operation string) (publicUrl string, contentHash string, err error) {
+	ctx, endSpan := traceSpan(ctx, "storage.put")
+	defer endSpan()
 
 	reador := bytes.NewReader(img.Body)
+	hasher := sha256.New()
+	tee := io.TeeReader(reador, hasher)
 
-	_, err = minioClient.PutObject(opts.Bucket, fileName, reador, reador.Size(), minio.PutObjectOptions{ContentType: img.Mime})
+	start := time.Now()
+	publicUrl, err = storage.Put(ctx, fileName, tee, reador.Size(), img.Mime)
+	storageUploadDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
 	if err != nil {
-		exitWithError("Eror while PutObject: %s", err)
-		return
+		return "", "", err
 	}
 
-	publicUrl = fmt.Sprintf("https://%s/%s/%s", opts.Endpoint, opts.Bucket, fileName)
+	contentHash = hex.EncodeToString(hasher.Sum(nil))
+	return publicUrl, contentHash, nil
+}
+
+// normalizedCacheQuery strips the parameters that carry auth/signature
+// tokens rather than describe the transform, so that requests differing
+// only in those fall on the same cache entry / file hash. The raw type
+// parameter is dropped as well: responseCacheKey appends the negotiated
+// output type in its place, and the uploaded file name carries it as its
+// extension. Other parameters that affect the processed output (quality,
+// ...) are kept, since dropping them would let requests that want different
+// bytes collide on the same entry.
+func normalizedCacheQuery(query url.Values) url.Values {
+	q := url.Values{}
+	for k, v := range query {
+		switch k {
+		case "jwt", "sign", "type":
+			continue
+		}
+		q[k] = v
+	}
+	return q
+}
 
-	return
+// responseCacheKey builds the lookup key for the ETag response cache out of
+// the request path, its normalized query, a content hash of the source
+// image bytes (so two different uploads to the same endpoint+query never
+// collide), and resolvedType — the output type *after* content negotiation,
+// not the raw type= query value, so that a type=auto request cached for an
+// Accept: image/webp client isn't served back to a client negotiating jpeg.
+func responseCacheKey(r *http.Request, buf []byte, resolvedType string) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]) + r.URL.Path + "?" + normalizedCacheQuery(r.URL.Query()).Encode() + "&type=" + resolvedType
 }
 
 func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation Operation, o ServerOptions) {
@@ -129,28 +232,54 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 		return
 	}
 
+	claims := claimsFromContext(r.Context())
+	if claims != nil && !claims.AllowsDimensions(opts.Width, opts.Height) {
+		ErrorReply(r, w, ErrInvalidJWT, o)
+		return
+	}
+
+	cacheKey := responseCacheKey(r, buf, opts.Type)
+	if o.ResponseCache != nil {
+		if entry, ok := o.ResponseCache.Get(cacheKey); ok {
+			writeCachedResponse(w, r, entry, vary)
+			return
+		}
+	}
+
+	inputBytes.WithLabelValues(operationName(r)).Observe(float64(len(buf)))
+
+	_, endVipsSpan := traceSpan(r.Context(), "bimg.process")
+	vipsStart := time.Now()
 	image, err := Operation.Run(buf, opts)
+	vipsDuration.WithLabelValues(operationName(r)).Observe(time.Since(vipsStart).Seconds())
+	endVipsSpan()
 	if err != nil {
 		ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
 		return
 	}
 
+	outputBytes.WithLabelValues(operationName(r)).Observe(float64(len(image.Body)))
+
 	_, handler, _ := r.FormFile(formFieldName)
 
 	destPath := "images"
 	if vs := r.Form["dest"]; len(vs) > 0 {
 		destPath = vs[0]
 	}
-	fileName := handler.Filename
+	if claims != nil {
+		if claims.Bucket != "" {
+			destPath = claims.Bucket
+		} else if claims.Dest != "" {
+			destPath = claims.Dest
+		}
+	}
+	destPath = sanitizeStorageSegment(destPath)
+	fileName := filepath.Base(handler.Filename)
 	if destPath != "" {
-		fileName = fmt.Sprintf("%s/%s", destPath, handler.Filename)
+		fileName = fmt.Sprintf("%s/%s", destPath, fileName)
 	}
 
-	query := r.URL.Query()
-	query.Del("type")
-	query.Del("quality")
-	query.Del("sign")
-	query.Del("jwt")
+	query := normalizedCacheQuery(r.URL.Query())
 	hash := ""
 	if len(query) > 0 {
 		hasher := md5.New()
@@ -165,12 +294,25 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 	}
 	fileName = fileName[:len(fileName) - len(oldExt)] + hash + newExt
 
-	publicUrl, err := UploadMinio(&image, fileName, &o.Minio)
+	publicUrl, contentHash, err := uploadToStorage(r.Context(), o.Storage, &image, fileName, operationName(r))
 	if err != nil {
-		ErrorReply(r, w, NewError("Error while upload to Minio: "+err.Error(), BadRequest), o)
+		ErrorReply(r, w, NewError("Error while upload to storage: "+err.Error(), BadRequest), o)
 		return
 	}
 
+	etag := `"` + contentHash + `"`
+	lastModified := time.Now()
+	if o.ResponseCache != nil {
+		o.ResponseCache.Set(cacheEntry{
+			key:          cacheKey,
+			etag:         etag,
+			lastModified: lastModified,
+			publicURL:    publicUrl,
+		})
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
 	w.Header().Set("Content-Type", "text/html")
 	if vary != "" {
 		w.Header().Set("Vary", vary)
@@ -178,6 +320,26 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 	_, _ = w.Write([]byte(publicUrl))
 }
 
+// writeCachedResponse answers a request that hit the response cache,
+// returning 304 Not Modified when the client's conditional headers already
+// match the cached variant, or the previously uploaded URL otherwise —
+// either way skipping the bimg pipeline and the Minio upload.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, entry cacheEntry, vary string) {
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Set("Last-Modified", entry.lastModified.UTC().Format(http.TimeFormat))
+	if vary != "" {
+		w.Header().Set("Vary", vary)
+	}
+
+	if conditionalRequestSatisfied(r, entry.etag, entry.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	_, _ = w.Write([]byte(entry.publicURL))
+}
+
 func formController(w http.ResponseWriter, r *http.Request) {
 	operations := []struct {
 		name   string
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// contextKey namespaces values stored on the request context so they don't
+// collide with keys set by other packages.
+type contextKey string
+
+const claimsContextKey contextKey = "imaginary.jwtClaims"
+
+// defaultJwksCacheTTL is how long fetched JWKS keys are reused before being
+// refetched, when ServerOptions doesn't specify JwksCacheTTL.
+const defaultJwksCacheTTL = 5 * time.Minute
+
+// ImageClaims are the claims imaginary understands out of a bearer token:
+// the standard registered claims (exp, nbf, iss, aud) plus the custom claims
+// that scope what an image endpoint is allowed to do on behalf of the token.
+type ImageClaims struct {
+	Ops          []string `json:"ops,omitempty"`
+	MaxWidth     int      `json:"maxWidth,omitempty"`
+	MaxHeight    int      `json:"maxHeight,omitempty"`
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	Bucket       string   `json:"bucket,omitempty"`
+	Dest         string   `json:"dest,omitempty"`
+	jwt.StandardClaims
+}
+
+// AllowsOperation reports whether the token authorizes the named operation
+// (e.g. "resize", "crop"). An empty Ops claim allows every operation.
+func (c *ImageClaims) AllowsOperation(name string) bool {
+	if len(c.Ops) == 0 {
+		return true
+	}
+	for _, op := range c.Ops {
+		if op == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHost reports whether the token authorizes fetching a URL source from
+// host. An empty AllowedHosts claim allows every host.
+func (c *ImageClaims) AllowsHost(host string) bool {
+	if len(c.AllowedHosts) == 0 {
+		return true
+	}
+	for _, h := range c.AllowedHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsDimensions reports whether width/height stay within the token's
+// maximum output dimensions. A zero maximum leaves that dimension unbounded.
+func (c *ImageClaims) AllowsDimensions(width, height int) bool {
+	if c.MaxWidth > 0 && width > c.MaxWidth {
+		return false
+	}
+	if c.MaxHeight > 0 && height > c.MaxHeight {
+		return false
+	}
+	return true
+}
+
+// claimsFromContext extracts the ImageClaims stored by validateJWT, or nil
+// when the request wasn't authenticated with a JWT.
+func claimsFromContext(ctx context.Context) *ImageClaims {
+	claims, _ := ctx.Value(claimsContextKey).(*ImageClaims)
+	return claims
+}
+
+// jwksCache fetches and caches signing keys from a JWKS endpoint by "kid",
+// so RS256/ES256 verification doesn't refetch the key set on every request.
+type jwksCache struct {
+	mu      sync.Mutex
+	url     string
+	ttl     time.Duration
+	fetched time.Time
+	keys    map[string]interface{}
+}
+
+func newJWKSCache(url string, ttl time.Duration) *jwksCache {
+	if ttl <= 0 {
+		ttl = defaultJwksCacheTTL
+	}
+	return &jwksCache{url: url, ttl: ttl, keys: make(map[string]interface{})}
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksDocument struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// key returns the public key for kid, refreshing the key set from the JWKS
+// endpoint when the cache is empty or stale.
+func (c *jwksCache) key(kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.keys[kid]; ok && time.Since(c.fetched) < c.ttl {
+		return key, nil
+	}
+
+	resp, err := http.Get(c.url)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: fetch %s: %w", c.url, err)
+	}
+	defer resp.Body.Close()
+
+	var doc jwksDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("jwks: decode %s: %w", c.url, err)
+	}
+
+	keys := make(map[string]interface{}, len(doc.Keys))
+	for _, k := range doc.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+
+	c.keys = keys
+	c.fetched = time.Now()
+
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("jwks: unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+// publicKey decodes a single JWK into the crypto key type jwt-go expects for
+// RS256 (*rsa.PublicKey) or ES256 (*ecdsa.PublicKey) verification.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("jwks: unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+
+	default:
+		return nil, fmt.Errorf("jwks: unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metric label taxonomy follows SeaweedFS's VolumeServerRequestCounter /
+// RequestHistogram split: the request counter and the latency, byte, vips
+// and storage histograms carry an "operation" label (the route name, e.g.
+// "resize", "crop") rather than the raw path, so cardinality stays bounded
+// regardless of query parameters or IDs in the URL (chunked upload session
+// IDs, for instance). The rejection, failure and cache counters carry no
+// labels.
+var (
+	requestTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "imaginary_request_total",
+		Help: "Total HTTP requests, by operation and status code.",
+	}, []string{"operation", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imaginary_request_duration_seconds",
+		Help:    "Request latency in seconds, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	inputBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imaginary_input_bytes",
+		Help:    "Size of the source image fetched for processing, by operation.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"operation"})
+
+	outputBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imaginary_output_bytes",
+		Help:    "Size of the processed image, by operation.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	}, []string{"operation"})
+
+	vipsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imaginary_vips_duration_seconds",
+		Help:    "Time spent inside the bimg/libvips pipeline, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	storageUploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "imaginary_storage_upload_duration_seconds",
+		Help:    "Time spent uploading the processed output to the storage backend, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	throttleRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imaginary_throttle_rejections_total",
+		Help: "Requests rejected by the concurrency throttle.",
+	})
+
+	jwtFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imaginary_jwt_failures_total",
+		Help: "Requests rejected for a missing, invalid or unauthorized JWT.",
+	})
+
+	urlSignatureFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imaginary_url_signature_failures_total",
+		Help: "Requests rejected for a missing or mismatched URL signature.",
+	})
+
+	responseCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imaginary_response_cache_hits_total",
+		Help: "ETag response cache hits.",
+	})
+
+	responseCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "imaginary_response_cache_misses_total",
+		Help: "ETag response cache misses.",
+	})
+)
+
+// metricsHandler exposes the process's Prometheus registry in text format.
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// statusRecorder captures the status code a handler wrote, since
+// http.ResponseWriter doesn't expose it after the fact.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentHandler wraps next with a request counter and a latency
+// histogram labeled by operation.
+func instrumentHandler(next http.Handler, operation string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		requestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		requestTotal.WithLabelValues(operation, strconv.Itoa(rec.status)).Inc()
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -34,7 +35,7 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 	if o.HTTPCacheTTL >= 0 {
 		next = setCacheHeaders(next, o.HTTPCacheTTL)
 	}
-	if len(o.Jwt.SignatureSecret) > 0 {
+	if len(o.Jwt.SignatureSecret) > 0 || o.Jwt.JwksURL != "" {
 		next = validateJWT(next, o)
 	}
 
@@ -84,6 +85,10 @@ func throttle(next http.Handler, o ServerOptions) http.Handler {
 	httpRateLimiter := throttled.HTTPRateLimiter{
 		RateLimiter: rateLimiter,
 		VaryBy:      &throttled.VaryBy{Method: true},
+		DeniedHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			throttleRejections.Inc()
+			http.Error(w, "limit exceeded", http.StatusTooManyRequests)
+		}),
 	}
 
 	return httpRateLimiter.RateLimit(next)
@@ -164,7 +169,7 @@ func getCacheControl(ttl int) string {
 }
 
 func isPublicPath(path string) bool {
-	return path == "/" || path == "/health" || path == "/form"
+	return path == "/" || path == "/health" || path == "/form" || path == "/metrics"
 }
 
 func validateURLSignature(next http.Handler, o ServerOptions) http.Handler {
@@ -182,11 +187,13 @@ func validateURLSignature(next http.Handler, o ServerOptions) http.Handler {
 
 		urlSign, err := base64.RawURLEncoding.DecodeString(sign)
 		if err != nil {
+			urlSignatureFailures.Inc()
 			ErrorReply(r, w, ErrInvalidURLSignature, o)
 			return
 		}
 
 		if hmac.Equal(urlSign, expectedSign) == false {
+			urlSignatureFailures.Inc()
 			ErrorReply(r, w, ErrURLSignatureMismatch, o)
 			return
 		}
@@ -195,13 +202,20 @@ func validateURLSignature(next http.Handler, o ServerOptions) http.Handler {
 	})
 }
 
+// jwksAlgorithms lists the signing methods verified against a JWKS endpoint
+// by key ID, rather than the single static o.Jwt.SignatureSecret.
+var jwksAlgorithms = map[string]bool{"RS256": true, "ES256": true}
+
 func validateJWT(next http.Handler, o ServerOptions) http.Handler {
+	jwks := newJWKSCache(o.Jwt.JwksURL, time.Duration(o.Jwt.JwksCacheTTL)*time.Second)
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		auth := r.Header.Get("Authorization")
 		tokenJwt := ""
 		if auth != "" {
 			authArr := strings.Split(auth, " ")
 			if len(authArr) != 2 || authArr[0] != "Bearer" {
+				jwtFailures.Inc()
 				ErrorReply(r, w, ErrInvalidJWT, o)
 				return
 			}
@@ -212,17 +226,47 @@ func validateJWT(next http.Handler, o ServerOptions) http.Handler {
 		}
 
 		keyFunc := func (t *jwt.Token) (interface{}, error) {
-			if t.Method.Alg() != o.Jwt.Algorithm {
+			alg := t.Method.Alg()
+			if jwksAlgorithms[alg] {
+				if o.Jwt.JwksURL == "" {
+					return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+				}
+				kid, _ := t.Header["kid"].(string)
+				return jwks.key(kid)
+			}
+			if alg != o.Jwt.Algorithm {
 				return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
 			}
 			return o.Jwt.SignatureSecret, nil
 		}
-		token, err := jwt.Parse(tokenJwt, keyFunc)
+
+		claims := &ImageClaims{}
+		token, err := jwt.ParseWithClaims(tokenJwt, claims, keyFunc)
 		if err != nil || !token.Valid {
+			jwtFailures.Inc()
 			ErrorReply(r, w, ErrInvalidJWT, o)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		if o.Jwt.Issuer != "" && claims.Issuer != o.Jwt.Issuer {
+			jwtFailures.Inc()
+			ErrorReply(r, w, ErrInvalidJWT, o)
+			return
+		}
+		if o.Jwt.Audience != "" && !claims.VerifyAudience(o.Jwt.Audience, true) {
+			jwtFailures.Inc()
+			ErrorReply(r, w, ErrInvalidJWT, o)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// operationName extracts the trailing path segment used to route the
+// request (e.g. "/resize" -> "resize"), for matching against an "ops" claim.
+func operationName(r *http.Request) string {
+	parts := strings.Split(r.URL.Path, "/")
+	return parts[len(parts)-1]
+}
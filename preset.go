@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// PresetVariant is one named output a preset produces: an operation plus the
+// query parameters it runs with. Widths, when set, expands the variant into
+// one output per width (e.g. a "responsive" set of sizes).
+type PresetVariant struct {
+	Op     string            `json:"op" yaml:"op"`
+	Params map[string]string `json:"params,omitempty" yaml:"params,omitempty"`
+	Widths []int             `json:"widths,omitempty" yaml:"widths,omitempty"`
+}
+
+// Preset groups the named variants a single /process request produces.
+type Preset struct {
+	Variants map[string]PresetVariant `json:"variants" yaml:"variants"`
+}
+
+// PresetStore holds the hot-reloadable set of presets loaded from a YAML or
+// JSON file, re-reading it whenever its mtime advances.
+type PresetStore struct {
+	mu       sync.RWMutex
+	path     string
+	presets  map[string]Preset
+	loadedAt time.Time
+}
+
+// NewPresetStore loads presets from path. An empty path yields an empty
+// store, so /process can be wired up even before presets exist; every
+// request then fails with an "Unknown preset" BadRequest error.
+func NewPresetStore(path string) (*PresetStore, error) {
+	store := &PresetStore{path: path, presets: map[string]Preset{}}
+	if path == "" {
+		return store, nil
+	}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *PresetStore) reload() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("presets: read %s: %w", s.path, err)
+	}
+
+	presets := map[string]Preset{}
+	if filepath.Ext(s.path) == ".json" {
+		err = json.Unmarshal(data, &presets)
+	} else {
+		err = yaml.Unmarshal(data, &presets)
+	}
+	if err != nil {
+		return fmt.Errorf("presets: parse %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.presets = presets
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// reloadIfStale re-reads the preset file when it has been modified since the
+// last load, giving operators hot-reload without a restart.
+func (s *PresetStore) reloadIfStale() {
+	if s.path == "" {
+		return
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return
+	}
+
+	s.mu.RLock()
+	stale := info.ModTime().After(s.loadedAt)
+	s.mu.RUnlock()
+
+	if stale {
+		_ = s.reload()
+	}
+}
+
+// Get returns the named preset, reloading from disk first if it changed.
+func (s *PresetStore) Get(name string) (Preset, bool) {
+	s.reloadIfStale()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	preset, ok := s.presets[name]
+	return preset, ok
+}
+
+// presetJob is a single variant expanded to its final query parameters,
+// ready to run through an Operation.
+type presetJob struct {
+	variant string
+	op      string
+	query   url.Values
+}
+
+// expandVariants flattens a preset's variants into jobs, expanding any
+// Widths into one job per width (e.g. "responsive-320", "responsive-640").
+func expandVariants(variants map[string]PresetVariant) []presetJob {
+	var jobs []presetJob
+	for name, v := range variants {
+		if len(v.Widths) == 0 {
+			jobs = append(jobs, presetJob{variant: name, op: v.Op, query: variantQuery(v.Params)})
+			continue
+		}
+		for _, width := range v.Widths {
+			q := variantQuery(v.Params)
+			q.Set("width", strconv.Itoa(width))
+			jobs = append(jobs, presetJob{variant: fmt.Sprintf("%s-%d", name, width), op: v.Op, query: q})
+		}
+	}
+	return jobs
+}
+
+func variantQuery(params map[string]string) url.Values {
+	q := url.Values{}
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	return q
+}
+
+// negotiateOutputType picks the output format from an Accept header:
+// AVIF if image/avif is listed anywhere, otherwise whatever
+// determineAcceptMimeType yields (the first of WebP, PNG or JPEG in header
+// order).
+func negotiateOutputType(accept string) string {
+	for _, v := range strings.Split(accept, ",") {
+		mediaType, _, _ := mime.ParseMediaType(v)
+		if mediaType == "image/avif" {
+			return "avif"
+		}
+	}
+	return determineAcceptMimeType(accept)
+}
+
+// VariantResult is one entry of the /process manifest.
+type VariantResult struct {
+	Variant string `json:"-"`
+	URL     string `json:"url,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Bytes   int    `json:"bytes,omitempty"`
+	Mime    string `json:"mime,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func imageDimensions(buf []byte) (int, int) {
+	size, err := bimg.NewImage(buf).Size()
+	if err != nil {
+		return 0, 0
+	}
+	return size.Width, size.Height
+}
+
+func extensionFor(mimeType string) string {
+	switch mimeType {
+	case "image/webp":
+		return ".webp"
+	case "image/avif":
+		return ".avif"
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	default:
+		return ""
+	}
+}
+
+// processMiddleware serves /process: given one upload and a preset name, it
+// runs every variant of the preset concurrently through the existing
+// Operation functions and returns a manifest of the uploaded results.
+type processMiddleware struct {
+	o       ServerOptions
+	presets *PresetStore
+}
+
+func (m *processMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presetName := r.URL.Query().Get("preset")
+	if presetName == "" {
+		ErrorReply(r, w, NewError("Missing preset parameter", BadRequest), m.o)
+		return
+	}
+
+	preset, ok := m.presets.Get(presetName)
+	if !ok {
+		ErrorReply(r, w, NewError(fmt.Sprintf("Unknown preset %q", presetName), BadRequest), m.o)
+		return
+	}
+
+	imageSource := MatchSource(r)
+	if imageSource == nil {
+		ErrorReply(r, w, ErrMissingImageSource, m.o)
+		return
+	}
+
+	buf, err := imageSource.GetImage(r)
+	if err != nil {
+		ErrorReply(r, w, NewError(err.Error(), BadRequest), m.o)
+		return
+	}
+	if len(buf) == 0 {
+		ErrorReply(r, w, ErrEmptyBody, m.o)
+		return
+	}
+
+	jobs := expandVariants(preset.Variants)
+	if len(jobs) == 0 {
+		ErrorReply(r, w, NewError("Preset has no variants", BadRequest), m.o)
+		return
+	}
+
+	perJob := make([][]VariantResult, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job presetJob) {
+			defer wg.Done()
+			perJob[i] = m.runVariant(r, buf, job, presetName)
+		}(i, job)
+	}
+	wg.Wait()
+
+	manifest := make(map[string]VariantResult)
+	for _, results := range perJob {
+		for _, res := range results {
+			manifest[res.Variant] = res
+		}
+	}
+
+	body, _ := json.Marshal(manifest)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+// runVariant runs a single job, plus a JPEG fallback alongside any output
+// type other than JPEG (negotiated, or set in the variant's params) so
+// clients without modern format support still get something decodable.
+func (m *processMiddleware) runVariant(r *http.Request, buf []byte, job presetJob, presetName string) []VariantResult {
+	operation, ok := operationsByName[job.op]
+	if !ok {
+		return []VariantResult{{Variant: job.variant, Error: fmt.Sprintf("unknown operation %q", job.op)}}
+	}
+
+	opts := readParams(job.query)
+	if opts.Type == "" || opts.Type == "auto" {
+		opts.Type = negotiateOutputType(r.Header.Get("Accept"))
+	}
+
+	results := []VariantResult{m.runOnce(r, buf, operation, opts, job.variant, presetName)}
+
+	if opts.Type != "" && opts.Type != "jpeg" {
+		fallback := opts
+		fallback.Type = "jpeg"
+		results = append(results, m.runOnce(r, buf, operation, fallback, job.variant+"-jpeg", presetName))
+	}
+
+	return results
+}
+
+func (m *processMiddleware) runOnce(r *http.Request, buf []byte, operation Operation, opts ImageOptions, variant, presetName string) VariantResult {
+	image, err := operation.Run(buf, opts)
+	if err != nil {
+		return VariantResult{Variant: variant, Error: err.Error()}
+	}
+
+	width, height := imageDimensions(image.Body)
+	fileName := fmt.Sprintf("presets/%s/%s%s", presetName, variant, extensionFor(image.Mime))
+
+	publicUrl, _, err := uploadToStorage(r.Context(), m.o.Storage, &image, fileName, "process")
+	if err != nil {
+		return VariantResult{Variant: variant, Error: err.Error()}
+	}
+
+	return VariantResult{
+		Variant: variant,
+		URL:     publicUrl,
+		Width:   width,
+		Height:  height,
+		Bytes:   len(image.Body),
+		Mime:    image.Mime,
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"github.com/minio/minio-go"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -26,6 +25,10 @@ type JwtOptions struct {
 	SignatureSecret       []byte
 	SignatureSecretBase64 string
 	Algorithm             string
+	Issuer                string
+	Audience              string
+	JwksURL               string
+	JwksCacheTTL          int
 }
 
 type CORS struct {
@@ -42,10 +45,22 @@ type ServerOptions struct {
 	CORS               CORS
 	Video              Video
 
+	StorageBackend     string
+	S3                 S3Options
+	GCS                GCSOptions
+	Azure              AzureOptions
+	Filesystem         FilesystemOptions
+	Storage            Storage
+
+	PresetsFile        string
+	Presets            *PresetStore
+
 	Port               int
 	Burst              int
 	Concurrency        int
 	HTTPCacheTTL       int
+	ResponseCacheSize  int
+	ResponseCache      *ResponseCache
 	HTTPReadTimeout    int
 	HTTPWriteTimeout   int
 	MaxAllowedSize     int
@@ -84,6 +99,24 @@ func (e Endpoints) IsValid(r *http.Request) bool {
 }
 
 func Server(o ServerOptions) error {
+	if o.ResponseCache == nil {
+		o.ResponseCache = NewResponseCache(o.ResponseCacheSize)
+	}
+	if o.Storage == nil {
+		storage, err := newStorageBackend(o)
+		if err != nil {
+			return err
+		}
+		o.Storage = storage
+	}
+	if o.Presets == nil {
+		presets, err := NewPresetStore(o.PresetsFile)
+		if err != nil {
+			return err
+		}
+		o.Presets = presets
+	}
+
 	addr := o.Address + ":" + strconv.Itoa(o.Port)
 	handler := NewLog(NewServerMux(o), os.Stdout)
 
@@ -111,35 +144,69 @@ func join(o ServerOptions, route string) string {
 	return path.Join(o.PathPrefix, route)
 }
 
+// observe wraps a fully-built route handler with request metrics and an
+// OpenTelemetry span, both labeled by operation (the route name, not the
+// raw path, so IDs in a path like /video/upload/<id> don't blow up
+// cardinality). It is the outermost layer for every route in NewServerMux,
+// so Middleware, ImageMiddleware and imageHandler all run inside the span
+// and can read it off the request context to open child spans.
+func observe(operation string, next http.Handler) http.Handler {
+	return traceHandler(instrumentHandler(next, operation), operation)
+}
+
 // NewServerMux creates a new HTTP server route multiplexer.
 func NewServerMux(o ServerOptions) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.Handle(join(o, "/"), Middleware(indexController, o))
-	mux.Handle(join(o, "/form"), Middleware(formController, o))
-	mux.Handle(join(o, "/health"), Middleware(healthController, o))
+	mux.Handle(join(o, "/"), observe("index", Middleware(indexController, o)))
+	mux.Handle(join(o, "/form"), observe("form", Middleware(formController, o)))
+	mux.Handle(join(o, "/health"), observe("health", Middleware(healthController, o)))
+	mux.Handle(join(o, "/metrics"), observe("metrics", metricsHandler()))
 
 	image := ImageMiddleware(o)
-	mux.Handle(join(o, "/resize"), image(Resize))
-	mux.Handle(join(o, "/fit"), image(Fit))
-	mux.Handle(join(o, "/enlarge"), image(Enlarge))
-	mux.Handle(join(o, "/extract"), image(Extract))
-	mux.Handle(join(o, "/crop"), image(Crop))
-	mux.Handle(join(o, "/smartcrop"), image(SmartCrop))
-	mux.Handle(join(o, "/rotate"), image(Rotate))
-	mux.Handle(join(o, "/flip"), image(Flip))
-	mux.Handle(join(o, "/flop"), image(Flop))
-	mux.Handle(join(o, "/thumbnail"), image(Thumbnail))
-	mux.Handle(join(o, "/zoom"), image(Zoom))
-	mux.Handle(join(o, "/convert"), image(Convert))
-	mux.Handle(join(o, "/watermark"), image(Watermark))
-	mux.Handle(join(o, "/watermarkimage"), image(WatermarkImage))
-	mux.Handle(join(o, "/info"), image(Info))
-	mux.Handle(join(o, "/blur"), image(GaussianBlur))
-	mux.Handle(join(o, "/pipeline"), image(Pipeline))
+	mux.Handle(join(o, "/resize"), observe("resize", image(Resize)))
+	mux.Handle(join(o, "/fit"), observe("fit", image(Fit)))
+	mux.Handle(join(o, "/enlarge"), observe("enlarge", image(Enlarge)))
+	mux.Handle(join(o, "/extract"), observe("extract", image(Extract)))
+	mux.Handle(join(o, "/crop"), observe("crop", image(Crop)))
+	mux.Handle(join(o, "/smartcrop"), observe("smartcrop", image(SmartCrop)))
+	mux.Handle(join(o, "/rotate"), observe("rotate", image(Rotate)))
+	mux.Handle(join(o, "/flip"), observe("flip", image(Flip)))
+	mux.Handle(join(o, "/flop"), observe("flop", image(Flop)))
+	mux.Handle(join(o, "/thumbnail"), observe("thumbnail", image(Thumbnail)))
+	mux.Handle(join(o, "/zoom"), observe("zoom", image(Zoom)))
+	mux.Handle(join(o, "/convert"), observe("convert", image(Convert)))
+	mux.Handle(join(o, "/watermark"), observe("watermark", image(Watermark)))
+	mux.Handle(join(o, "/watermarkimage"), observe("watermarkimage", image(WatermarkImage)))
+	mux.Handle(join(o, "/info"), observe("info", image(Info)))
+	mux.Handle(join(o, "/blur"), observe("blur", image(GaussianBlur)))
+	mux.Handle(join(o, "/pipeline"), observe("pipeline", image(Pipeline)))
 
 	video := VideoMiddleware{o}
-	mux.Handle(join(o, "/video"), validate(validateJWT(&video, o), o))
+	mux.Handle(join(o, "/video"), observe("video", validate(validateJWT(&video, o), o)))
+
+	uploadDir := o.Video.TempDir
+	if uploadDir == "" {
+		uploadDir = os.TempDir()
+	}
+	uploadStore := newUploadSessionStore(uploadDir)
+
+	imageUploadBase := join(o, "/upload")
+	imageUpload := &uploadMiddleware{o: o, kind: uploadKindImage, base: imageUploadBase, store: uploadStore}
+	mux.Handle(imageUploadBase, observe("upload", validate(validateJWT(imageUpload, o), o)))
+	mux.Handle(imageUploadBase+"/", observe("upload", validate(validateJWT(imageUpload, o), o)))
+
+	videoUploadBase := join(o, "/video/upload")
+	videoUpload := &uploadMiddleware{o: o, kind: uploadKindVideo, base: videoUploadBase, store: uploadStore}
+	mux.Handle(videoUploadBase, observe("video-upload", validate(validateJWT(videoUpload, o), o)))
+	mux.Handle(videoUploadBase+"/", observe("video-upload", validate(validateJWT(videoUpload, o), o)))
+
+	process := &processMiddleware{o: o, presets: o.Presets}
+	processHandler := validateImage(Middleware(process.ServeHTTP, o), o)
+	if o.EnableURLSignature {
+		processHandler = validateURLSignature(processHandler, o)
+	}
+	mux.Handle(join(o, "/process"), observe("process", processHandler))
 
 	return mux
 }
@@ -159,15 +226,6 @@ func RandStringRunes(n int) string {
 }
 
 func (m *VideoMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-
-	// Initialize minio client object.
-	opts := m.opts.Minio
-	minioClient, err := minio.New(opts.Endpoint, opts.AccessKey, opts.SecretKey, opts.UseSSL)
-	if err != nil {
-		fmt.Printf("Failed to initialize Minio: %s", err)
-		return
-	}
-
 	videoFile, header, err := r.FormFile("file")
 	if err != nil {
 		fmt.Printf("Invalid format: %s", err)
@@ -193,14 +251,14 @@ func (m *VideoMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	fileName = fileName[:len(fileName) - len(oldExt)] + hash + newExt
 
-	_, err = minioClient.PutObject(opts.Bucket, fileName, videoFile, header.Size, minio.PutObjectOptions{ContentType: contentType})
+	start := time.Now()
+	publicUrl, err := m.opts.Storage.Put(r.Context(), fileName, videoFile, header.Size, contentType)
+	storageUploadDuration.WithLabelValues("video").Observe(time.Since(start).Seconds())
 	if err != nil {
-		fmt.Printf("Eror while PutObject: %s", err)
+		fmt.Printf("Error while upload to storage: %s", err)
 		return
 	}
 
-	publicUrl := fmt.Sprintf(`https://%s/%s/%s`, opts.Endpoint, opts.Bucket, fileName)
-
 	w.Header().Set("Content-Type", "text/html")
 	_, _ = w.Write([]byte(publicUrl))
 
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Storage backend identifiers accepted by ServerOptions.StorageBackend.
+const (
+	StorageMinio      = "minio"
+	StorageS3         = "s3"
+	StorageGCS        = "gcs"
+	StorageAzure      = "azure"
+	StorageFilesystem = "filesystem"
+)
+
+// Storage abstracts the object store imaginary uploads processed images and
+// videos to, so the handlers aren't hard-wired to Minio. Get/Head also let
+// the URL-source fetcher read from the same backend, including private
+// buckets the source HTTP client can't reach directly.
+type Storage interface {
+	// Put uploads size bytes read from r under key and returns the public
+	// URL of the stored object.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (url string, err error)
+	// Get opens the object stored under key for reading. Callers must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Head reports whether an object exists under key.
+	Head(ctx context.Context, key string) (bool, error)
+	// Delete removes the object stored under key.
+	Delete(ctx context.Context, key string) error
+}
+
+// sanitizeStorageSegment strips path-traversal and separator components out
+// of a value (a dest/bucket prefix, or an uploaded filename) before it is
+// woven into a storage key, so an unauthenticated dest= field or a crafted
+// multipart filename can't walk the key outside the backend's root via "..".
+func sanitizeStorageSegment(s string) string {
+	s = strings.ReplaceAll(s, "\\", "/")
+	parts := strings.Split(s, "/")
+	kept := parts[:0]
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return strings.Join(kept, "/")
+}
+
+// newStorageBackend builds the Storage implementation selected by
+// o.StorageBackend, defaulting to Minio to match imaginary's historical
+// behavior when no backend is configured.
+func newStorageBackend(o ServerOptions) (Storage, error) {
+	switch o.StorageBackend {
+	case "", StorageMinio:
+		return newMinioStorage(o.Minio)
+	case StorageS3:
+		return newS3Storage(o.S3)
+	case StorageGCS:
+		return newGCSStorage(o.GCS)
+	case StorageAzure:
+		return newAzureStorage(o.Azure)
+	case StorageFilesystem:
+		return newFilesystemStorage(o.Filesystem)
+	default:
+		return nil, fmt.Errorf("storage: unknown backend %q", o.StorageBackend)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+// AzureOptions configures the Azure Blob Storage Storage backend.
+type AzureOptions struct {
+	Account   string
+	AccessKey string
+	Container string
+}
+
+// azureStorage is the Storage implementation backed by Azure Blob Storage.
+type azureStorage struct {
+	container azblob.ContainerURL
+	account   string
+}
+
+func newAzureStorage(opts AzureOptions) (Storage, error) {
+	credential, err := azblob.NewSharedKeyCredential(opts.Account, opts.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("azure: credentials: %w", err)
+	}
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	containerURL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", opts.Account, opts.Container))
+	if err != nil {
+		return nil, fmt.Errorf("azure: container url: %w", err)
+	}
+
+	return &azureStorage{container: azblob.NewContainerURL(*containerURL, pipeline), account: opts.Account}, nil
+}
+
+func (s *azureStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	blob := s.container.NewBlockBlobURL(key)
+	_, err := azblob.UploadStreamToBlockBlob(ctx, r, blob, azblob.UploadStreamToBlockBlobOptions{
+		BufferSize: 4 * 1024 * 1024,
+		MaxBuffers: 4,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType: contentType,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("azure: put %s: %w", key, err)
+	}
+	blobURL := blob.URL()
+	return blobURL.String(), nil
+}
+
+func (s *azureStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	blob := s.container.NewBlockBlobURL(key)
+	resp, err := blob.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("azure: get %s: %w", key, err)
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+func (s *azureStorage) Head(ctx context.Context, key string) (bool, error) {
+	blob := s.container.NewBlockBlobURL(key)
+	_, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("azure: head %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *azureStorage) Delete(ctx context.Context, key string) error {
+	blob := s.container.NewBlockBlobURL(key)
+	_, err := blob.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	if err != nil {
+		return fmt.Errorf("azure: delete %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FilesystemOptions configures the local filesystem Storage backend.
+type FilesystemOptions struct {
+	Directory string // root directory objects are written under
+	BaseURL   string // public URL prefix returned for stored objects
+}
+
+// filesystemStorage is the Storage implementation that writes to a local
+// directory, for single-node deployments that don't run an object store.
+type filesystemStorage struct {
+	dir     string
+	baseURL string
+}
+
+func newFilesystemStorage(opts FilesystemOptions) (Storage, error) {
+	if opts.Directory == "" {
+		return nil, fmt.Errorf("filesystem: directory is required")
+	}
+	if err := os.MkdirAll(opts.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("filesystem: create %s: %w", opts.Directory, err)
+	}
+	return &filesystemStorage{dir: opts.Directory, baseURL: opts.BaseURL}, nil
+}
+
+// path resolves key to an absolute path under s.dir. key is anchored to a
+// root before cleaning, so a ".."-laden key (from an unsanitized dest or
+// filename making its way into the object key) collapses back to s.dir
+// instead of escaping it.
+func (s *filesystemStorage) path(key string) string {
+	clean := filepath.Clean(string(filepath.Separator) + filepath.FromSlash(key))
+	return filepath.Join(s.dir, clean)
+}
+
+func (s *filesystemStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("filesystem: create dir for %s: %w", key, err)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("filesystem: create %s: %w", key, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return "", fmt.Errorf("filesystem: write %s: %w", key, err)
+	}
+
+	return s.baseURL + "/" + filepath.ToSlash(key), nil
+}
+
+func (s *filesystemStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("filesystem: get %s: %w", key, err)
+	}
+	return f, nil
+}
+
+func (s *filesystemStorage) Head(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("filesystem: head %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *filesystemStorage) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil {
+		return fmt.Errorf("filesystem: delete %s: %w", key, err)
+	}
+	return nil
+}
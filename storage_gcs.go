@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// GCSOptions configures the Google Cloud Storage Storage backend.
+type GCSOptions struct {
+	Bucket          string
+	CredentialsFile string // path to a service account JSON key, optional
+}
+
+// gcsStorage is the Storage implementation backed by Google Cloud Storage.
+type gcsStorage struct {
+	bucket *storage.BucketHandle
+	name   string
+}
+
+func newGCSStorage(opts GCSOptions) (Storage, error) {
+	ctx := context.Background()
+
+	var clientOpts []option.ClientOption
+	if opts.CredentialsFile != "" {
+		clientOpts = append(clientOpts, option.WithCredentialsFile(opts.CredentialsFile))
+	}
+
+	client, err := storage.NewClient(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: new client: %w", err)
+	}
+
+	return &gcsStorage{bucket: client.Bucket(opts.Bucket), name: opts.Bucket}, nil
+}
+
+func (s *gcsStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	w := s.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Close()
+		return "", fmt.Errorf("gcs: put %s: %w", key, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("gcs: put %s: %w", key, err)
+	}
+
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.name, key), nil
+}
+
+func (s *gcsStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := s.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: get %s: %w", key, err)
+	}
+	return r, nil
+}
+
+func (s *gcsStorage) Head(ctx context.Context, key string) (bool, error) {
+	_, err := s.bucket.Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("gcs: head %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *gcsStorage) Delete(ctx context.Context, key string) error {
+	if err := s.bucket.Object(key).Delete(ctx); err != nil {
+		return fmt.Errorf("gcs: delete %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go"
+)
+
+// minioStorage is the Storage implementation backed by a Minio (or other
+// S3-compatible) endpoint, carrying forward imaginary's original behavior.
+type minioStorage struct {
+	client *minio.Client
+	opts   MinioOptions
+}
+
+func newMinioStorage(opts MinioOptions) (Storage, error) {
+	client, err := minio.New(opts.Endpoint, opts.AccessKey, opts.SecretKey, opts.UseSSL)
+	if err != nil {
+		return nil, fmt.Errorf("minio: %w", err)
+	}
+	return &minioStorage{client: client, opts: opts}, nil
+}
+
+func (s *minioStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	_, err := s.client.PutObjectWithContext(ctx, s.opts.Bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return "", fmt.Errorf("minio: put %s: %w", key, err)
+	}
+	return fmt.Sprintf("https://%s/%s/%s", s.opts.Endpoint, s.opts.Bucket, key), nil
+}
+
+func (s *minioStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObjectWithContext(ctx, s.opts.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("minio: get %s: %w", key, err)
+	}
+	return obj, nil
+}
+
+func (s *minioStorage) Head(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.StatObject(s.opts.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if errResp := minio.ToErrorResponse(err); errResp.Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, fmt.Errorf("minio: head %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *minioStorage) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(s.opts.Bucket, key); err != nil {
+		return fmt.Errorf("minio: delete %s: %w", key, err)
+	}
+	return nil
+}
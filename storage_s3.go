@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Options configures the S3 Storage backend.
+type S3Options struct {
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Endpoint  string // optional, for S3-compatible providers
+	UseSSL    bool
+}
+
+// s3Storage is the Storage implementation backed by Amazon S3 (or an
+// S3-compatible endpoint) via aws-sdk-go v2.
+type s3Storage struct {
+	client *s3.Client
+	opts   S3Options
+}
+
+func newS3Storage(opts S3Options) (Storage, error) {
+	configOpts := []func(*config.LoadOptions) error{config.WithRegion(opts.Region)}
+	if opts.AccessKey != "" || opts.SecretKey != "" {
+		// Only override the default credential chain (env vars, shared
+		// config, IMDS/instance role) when static keys were actually given.
+		configOpts = append(configOpts, config.WithCredentialsProvider(aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: opts.AccessKey, SecretAccessKey: opts.SecretKey}, nil
+		})))
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), configOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("s3: load config: %w", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.Endpoint != ""
+	})
+
+	return &s3Storage{client: client, opts: opts}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) (string, error) {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.opts.Bucket),
+		Key:           aws.String(key),
+		Body:          r,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("s3: put %s: %w", key, err)
+	}
+
+	scheme := "https"
+	if !s.opts.UseSSL {
+		scheme = "http"
+	}
+	if s.opts.Endpoint != "" {
+		return fmt.Sprintf("%s://%s/%s/%s", scheme, s.opts.Endpoint, s.opts.Bucket, key), nil
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.opts.Bucket, s.opts.Region, key), nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3: get %s: %w", key, err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("s3: head %s: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.opts.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("s3: delete %s: %w", key, err)
+	}
+	return nil
+}
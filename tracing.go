@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the package-wide OpenTelemetry tracer. Exporting spans is left to
+// the operator's usual OTEL_* environment / SDK setup; imaginary only opens
+// and names the spans.
+var tracer = otel.Tracer("imaginary")
+
+// traceHandler starts a span named after operation around next and
+// propagates it through the request context, so every downstream call
+// (Middleware, ImageMiddleware, imageHandler, the storage upload) runs
+// inside the same trace as a child span.
+func traceHandler(next http.Handler, operation string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), operation, trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		))
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// traceSpan starts a child span for a sub-step of a request already carrying
+// a span (the bimg pipeline, a storage upload), returning a func to end it.
+func traceSpan(ctx context.Context, name string) (context.Context, func()) {
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func() { span.End() }
+}